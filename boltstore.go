@@ -0,0 +1,237 @@
+// Copyright 2016 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+package alpenhorn
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/boltdb/bolt"
+)
+
+var (
+	boltClientBucket  = []byte("client")
+	boltFriendsBucket = []byte("friends")
+)
+
+const (
+	boltClientKey   = "state"
+	boltKeywheelKey = "keywheel"
+
+	// boltRowVersion is stored as the first byte of every row so that a
+	// future format change can be detected and migrated per-row instead
+	// of requiring a whole-database migration.
+	boltRowVersion byte = 1
+)
+
+// boltStore is a ProfileStore backed by a local BoltDB database. Unlike
+// jsonFileStore, saving or deleting one friend only touches that
+// friend's row, and BoltDB's transactions mean a crash mid-write can't
+// leave the profile in a half-written state.
+type boltStore struct {
+	db         *bolt.DB
+	passphrase string
+}
+
+// NewBoltStore opens (creating if necessary) a BoltDB-backed ProfileStore
+// at path. If passphrase is non-empty, every row is sealed individually;
+// see seal.go.
+func NewBoltStore(path, passphrase string) (ProfileStore, error) {
+	db, err := bolt.Open(path, 0600, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists(boltClientBucket); err != nil {
+			return err
+		}
+		_, err := tx.CreateBucketIfNotExists(boltFriendsBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &boltStore{db: db, passphrase: passphrase}, nil
+}
+
+func (s *boltStore) encodeRow(v interface{}) ([]byte, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	if s.passphrase != "" {
+		data, err = seal(data, s.passphrase)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return append([]byte{boltRowVersion}, data...), nil
+}
+
+func (s *boltStore) decodeRow(row []byte, v interface{}) error {
+	if len(row) < 1 {
+		return errors.New("alpenhorn: truncated bolt row")
+	}
+	if row[0] != boltRowVersion {
+		return fmt.Errorf("alpenhorn: unsupported bolt row version %d", row[0])
+	}
+	data, err := maybeUnseal(row[1:], s.passphrase)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+func (s *boltStore) Load() (*persistedState, []byte, error) {
+	st := new(persistedState)
+	var keywheelData []byte
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		client := tx.Bucket(boltClientBucket)
+
+		row := client.Get([]byte(boltClientKey))
+		if row == nil {
+			return errors.New("alpenhorn: no client state in bolt store")
+		}
+		if err := s.decodeRow(row, st); err != nil {
+			return err
+		}
+
+		row = client.Get([]byte(boltKeywheelKey))
+		if row == nil {
+			return errors.New("alpenhorn: no keywheel in bolt store")
+		}
+		if len(row) < 1 {
+			return errors.New("alpenhorn: truncated bolt row")
+		}
+		data, err := maybeUnseal(row[1:], s.passphrase)
+		if err != nil {
+			return err
+		}
+		keywheelData = data
+
+		st.Friends = make(map[string]*persistedFriend)
+		return tx.Bucket(boltFriendsBucket).ForEach(func(k, row []byte) error {
+			friend := new(persistedFriend)
+			if err := s.decodeRow(row, friend); err != nil {
+				return err
+			}
+			st.Friends[string(k)] = friend
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return st, keywheelData, nil
+}
+
+// SaveClient persists everything in st except st.Friends, which is kept
+// in the friends bucket and saved independently via SaveFriend.
+func (s *boltStore) SaveClient(st *persistedState) error {
+	clientOnly := *st
+	clientOnly.Friends = nil
+	row, err := s.encodeRow(&clientOnly)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltClientBucket).Put([]byte(boltClientKey), row)
+	})
+}
+
+func (s *boltStore) SaveKeywheel(data []byte) error {
+	if s.passphrase != "" {
+		var err error
+		data, err = seal(data, s.passphrase)
+		if err != nil {
+			return err
+		}
+	}
+	row := append([]byte{boltRowVersion}, data...)
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltClientBucket).Put([]byte(boltKeywheelKey), row)
+	})
+}
+
+func (s *boltStore) SaveFriend(username string, friend *persistedFriend) error {
+	row, err := s.encodeRow(friend)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltFriendsBucket).Put([]byte(username), row)
+	})
+}
+
+func (s *boltStore) DeleteFriend(username string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltFriendsBucket).Delete([]byte(username))
+	})
+}
+
+func (s *boltStore) Close() error {
+	return s.db.Close()
+}
+
+// changePassphrase re-seals every row in a single BoltDB transaction, so
+// a crash partway through leaves either the old or the new passphrase in
+// effect, never a mix of both.
+func (s *boltStore) changePassphrase(old, newPassphrase string) error {
+	if old != s.passphrase {
+		return errors.New("alpenhorn: wrong passphrase")
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		client := tx.Bucket(boltClientBucket)
+		friends := tx.Bucket(boltFriendsBucket)
+
+		reseal := func(bucket *bolt.Bucket, key []byte) error {
+			row := bucket.Get(key)
+			if row == nil {
+				return nil
+			}
+			data, err := maybeUnseal(row[1:], old)
+			if err != nil {
+				return err
+			}
+			if newPassphrase != "" {
+				data, err = seal(data, newPassphrase)
+				if err != nil {
+					return err
+				}
+			}
+			return bucket.Put(key, append([]byte{boltRowVersion}, data...))
+		}
+
+		if err := reseal(client, []byte(boltClientKey)); err != nil {
+			return err
+		}
+		if err := reseal(client, []byte(boltKeywheelKey)); err != nil {
+			return err
+		}
+
+		var usernames [][]byte
+		if err := friends.ForEach(func(k, _ []byte) error {
+			usernames = append(usernames, append([]byte(nil), k...))
+			return nil
+		}); err != nil {
+			return err
+		}
+		for _, username := range usernames {
+			if err := reseal(friends, username); err != nil {
+				return err
+			}
+		}
+
+		s.passphrase = newPassphrase
+		return nil
+	})
+}
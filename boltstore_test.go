@@ -0,0 +1,95 @@
+// Copyright 2016 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+package alpenhorn
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestBoltStoreSaveLoadFriend(t *testing.T) {
+	store, err := NewBoltStore(filepath.Join(t.TempDir(), "profile.bolt"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	st := &persistedState{Username: "alice"}
+	if err := store.SaveClient(st); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.SaveKeywheel([]byte("keywheel bytes")); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.SaveFriend("bob", &persistedFriend{Username: "bob"}); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, _, err := store.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.Username != "alice" {
+		t.Fatalf("got username %q, want %q", loaded.Username, "alice")
+	}
+	if loaded.Friends["bob"] == nil {
+		t.Fatal("bob not found after SaveFriend")
+	}
+
+	// DeleteFriend must remove exactly that friend's row, without
+	// rewriting (or needing to re-save) the rest of the profile.
+	if err := store.DeleteFriend("bob"); err != nil {
+		t.Fatal(err)
+	}
+	loaded, _, err = store.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.Friends["bob"] != nil {
+		t.Fatal("bob still present after DeleteFriend")
+	}
+	if loaded.Username != "alice" {
+		t.Fatalf("DeleteFriend touched unrelated state: got username %q", loaded.Username)
+	}
+}
+
+func TestBoltStoreChangePassphraseSticks(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "profile.bolt")
+	store, err := NewBoltStore(path, "old-passphrase")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	if err := store.SaveClient(&persistedState{Username: "alice"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.SaveKeywheel([]byte("keywheel bytes")); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.SaveFriend("bob", &persistedFriend{Username: "bob"}); err != nil {
+		t.Fatal(err)
+	}
+
+	pc := store.(passphraseChanger)
+	if err := pc.changePassphrase("old-passphrase", "new-passphrase"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := store.Load(); err != nil {
+		t.Fatalf("loading with the same store after changePassphrase: %s", err)
+	}
+
+	store.Close()
+
+	stale, err := NewBoltStore(path, "old-passphrase")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stale.Close()
+	if _, _, err := stale.Load(); err == nil {
+		t.Fatal("bolt store still opens with the old passphrase after ChangePassphrase")
+	}
+}
@@ -0,0 +1,319 @@
+// Copyright 2016 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+package alpenhorn
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+
+	"golang.org/x/crypto/nacl/secretbox"
+	"vuvuzela.io/crypto/rand"
+)
+
+// GroupKeySize is the size of the symmetric key shared by a group's
+// members.
+const GroupKeySize = 32
+
+// Group is a set of mutually-friended users who share a symmetric group
+// identity. Unlike a Friend conversation, a group message is addressed
+// to the group's GroupID rather than to a single peer: every member
+// fetches the same mailbox entry and decrypts it with GroupKey.
+//
+// This file implements the client-side data model, invitation signing
+// and verification, and message encryption for groups. It does not by
+// itself let two clients exchange a message: actually posting to and
+// polling a coordinator.Server's Group-service mailbox by GroupID, and
+// draining pendingGroupInvites onto the wire, is round-runner plumbing
+// that belongs alongside the existing AddFriend/Dialing round code in
+// friend.go.
+//
+// TODO: add a Group coordinator service and a round runner that calls
+// ReceivedGroupInvite and ReceivedGroupMessage as mailbox entries come
+// in and drains pendingGroupInvites/outgoing group messages onto the
+// wire, the way the AddFriend and Dialing round runners already do for
+// friend requests and calls.
+type Group struct {
+	Name    string
+	GroupID [sha256.Size]byte
+	Members []string
+
+	groupKey [GroupKeySize]byte
+	client   *Client
+}
+
+// persistedGroup is the persisted representation of a Group. We use this
+// because Group.groupKey is unexported but must be persisted.
+//easyjson:readable
+type persistedGroup struct {
+	Name     string
+	GroupID  []byte
+	Members  []string
+	GroupKey []byte
+}
+
+// GroupInvitation is the invitation blob a group creator sends to each
+// invitee over an existing friend channel (see Friend.SendGroupInvite).
+// A recipient who accepts it has everything needed to address and
+// decrypt messages for the group: the member list, the symmetric group
+// key, and a signature from the creator binding the two together.
+//easyjson:readable
+type GroupInvitation struct {
+	Name    string
+	GroupID [sha256.Size]byte
+	Members []string
+
+	GroupKey [GroupKeySize]byte
+
+	CreatorUsername string
+	CreatorKey      ed25519.PublicKey
+	Signature       []byte
+}
+
+// GroupHandler is implemented by a Client's Handler when the
+// application wants group-conversation callbacks. It's kept as a
+// separate, optional interface — asserted with a type assertion on
+// c.Handler, the same pattern Client.ChangePassphrase uses for
+// passphraseChanger — so that embedding alpenhorn for friend/call
+// conversations alone doesn't also require implementing group support.
+type GroupHandler interface {
+	// ReceivedGroupInvite is called after a received GroupInvitation has
+	// been verified and turned into a usable Group.
+	ReceivedGroupInvite(group *Group)
+
+	// ReceivedGroupMessage is called after a group mailbox entry has
+	// been decrypted.
+	ReceivedGroupMessage(group *Group, message []byte)
+
+	// SentGroupMessage is called after a message has been sealed for
+	// posting to a group's mailbox.
+	SentGroupMessage(group *Group, message []byte)
+}
+
+// groupIDSigningContext is prepended to the data signed by a group's
+// creator, following the convention used elsewhere in alpenhorn of
+// domain-separating signatures by context.
+const groupIDSigningContext = "AlpenhornGroupID"
+
+// NewGroup creates a new group with a fresh random group key. creatorKey
+// is the long-term signing key of the user creating the group (normally
+// the local client); it's used to sign the group's identity so that
+// invitees can verify the invitation came from the group's creator.
+func NewGroup(name string, members []string, creatorUsername string, creatorKey ed25519.PrivateKey) (*Group, error) {
+	var groupKey [GroupKeySize]byte
+	if _, err := rand.Read(groupKey[:]); err != nil {
+		return nil, err
+	}
+
+	sig := ed25519.Sign(creatorKey, append([]byte(groupIDSigningContext), groupKey[:]...))
+	groupID := sha256.Sum256(append(groupKey[:], sig...))
+
+	return &Group{
+		Name:     name,
+		GroupID:  groupID,
+		Members:  members,
+		groupKey: groupKey,
+	}, nil
+}
+
+// invitation builds the GroupInvitation for group, signed by creatorKey.
+func (g *Group) invitation(creatorUsername string, creatorKey ed25519.PublicKey, creatorPriv ed25519.PrivateKey) *GroupInvitation {
+	sig := ed25519.Sign(creatorPriv, append([]byte(groupIDSigningContext), g.groupKey[:]...))
+	return &GroupInvitation{
+		Name:            g.Name,
+		GroupID:         g.GroupID,
+		Members:         g.Members,
+		GroupKey:        g.groupKey,
+		CreatorUsername: creatorUsername,
+		CreatorKey:      creatorKey,
+		Signature:       sig,
+	}
+}
+
+// verify checks that inv's signature was produced by inv.CreatorKey over
+// inv.GroupKey, and that it's consistent with inv.GroupID.
+func (inv *GroupInvitation) verify() error {
+	if !ed25519.Verify(inv.CreatorKey, append([]byte(groupIDSigningContext), inv.GroupKey[:]...), inv.Signature) {
+		return errors.New("alpenhorn: invalid group invitation signature")
+	}
+	wantID := sha256.Sum256(append(inv.GroupKey[:], inv.Signature...))
+	if wantID != inv.GroupID {
+		return errors.New("alpenhorn: group invitation id does not match group key")
+	}
+	return nil
+}
+
+// outgoingGroupInvite is a GroupInvitation queued for a friend by
+// Friend.SendGroupInvite; see flushPendingGroupInvitesLocked.
+//easyjson:readable
+type outgoingGroupInvite struct {
+	Friend string
+	Invite *GroupInvitation
+}
+
+// SendGroupInvite queues an invitation to join group, addressed to this
+// friend, in the client's pendingGroupInvites and persists the client.
+// Nothing in this package transmits queued invitations: they stay
+// queued until flushPendingGroupInvitesLocked returns them. A recipient
+// turns a delivered invitation into a usable Group with
+// Client.ReceivedGroupInvite.
+func (f *Friend) SendGroupInvite(group *Group) error {
+	c := f.client
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	inv := group.invitation(c.Username, c.LongTermPublicKey, c.LongTermPrivateKey)
+
+	c.pendingGroupInvites = append(c.pendingGroupInvites, &outgoingGroupInvite{
+		Friend: f.Username,
+		Invite: inv,
+	})
+	return c.persistClientLocked()
+}
+
+// sealGroupMessage encrypts message under the group's symmetric key for
+// posting to the group's shared mailbox (addressed by GroupID). Any
+// member can later open it with openGroupMessage and the same key.
+func sealGroupMessage(groupKey *[GroupKeySize]byte, nonce *[24]byte, message []byte) []byte {
+	return secretbox.Seal(nil, message, nonce, groupKey)
+}
+
+// openGroupMessage decrypts a message retrieved from the group's shared
+// mailbox.
+func openGroupMessage(groupKey *[GroupKeySize]byte, nonce *[24]byte, box []byte) ([]byte, bool) {
+	return secretbox.Open(nil, box, nonce, groupKey)
+}
+
+// SealMessage encrypts message for posting to this group's shared
+// mailbox, addressed by g.GroupID. nonce must never be reused with this
+// group's key; the caller that posts the mailbox entry is responsible
+// for picking a fresh one (e.g. from the round number).
+func (g *Group) SealMessage(nonce *[24]byte, message []byte) []byte {
+	return sealGroupMessage(&g.groupKey, nonce, message)
+}
+
+// OpenMessage decrypts a message retrieved from this group's shared
+// mailbox. The second return value is false if box does not decrypt
+// under this group's key and nonce, e.g. because it's not actually
+// addressed to this group.
+func (g *Group) OpenMessage(nonce *[24]byte, box []byte) ([]byte, bool) {
+	return openGroupMessage(&g.groupKey, nonce, box)
+}
+
+// GetGroup returns the named group, or nil if the client isn't a member
+// of it.
+func (c *Client) GetGroup(name string) *Group {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.groups[name]
+}
+
+// ReceivedGroupInvite verifies inv and, if it checks out, adds the
+// resulting group to the client's profile so SealMessage/OpenMessage
+// can be used for it right away, then invokes c.Handler's
+// ReceivedGroupInvite callback if it implements GroupHandler. It
+// returns the now-usable Group on success.
+//
+// Nothing in this package receives invitation envelopes; the caller
+// passes each received GroupInvitation to it.
+func (c *Client) ReceivedGroupInvite(inv *GroupInvitation) (*Group, error) {
+	if err := inv.verify(); err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	g := &Group{
+		Name:     inv.Name,
+		GroupID:  inv.GroupID,
+		Members:  inv.Members,
+		groupKey: inv.GroupKey,
+		client:   c,
+	}
+	if c.groups == nil {
+		c.groups = make(map[string]*Group)
+	}
+	c.groups[g.Name] = g
+	handler := c.Handler
+	err := c.persistClientLocked()
+	c.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	if gh, ok := handler.(GroupHandler); ok {
+		gh.ReceivedGroupInvite(g)
+	}
+	return g, nil
+}
+
+// ReceivedGroupMessage decrypts box, a mailbox entry retrieved for
+// group, and invokes c.Handler's ReceivedGroupMessage callback if it
+// implements GroupHandler. Nothing in this package polls a group's
+// mailbox; the caller passes each retrieved entry to it.
+func (c *Client) ReceivedGroupMessage(group *Group, nonce *[24]byte, box []byte) ([]byte, error) {
+	message, ok := group.OpenMessage(nonce, box)
+	if !ok {
+		return nil, errors.New("alpenhorn: failed to decrypt group message")
+	}
+
+	c.mu.Lock()
+	handler := c.Handler
+	c.mu.Unlock()
+	if gh, ok := handler.(GroupHandler); ok {
+		gh.ReceivedGroupMessage(group, message)
+	}
+	return message, nil
+}
+
+// SendGroupMessage seals message for posting to group's shared mailbox
+// and invokes c.Handler's SentGroupMessage callback if it implements
+// GroupHandler. It returns the sealed box; actually posting it to the
+// group's mailbox is the caller's responsibility.
+func (c *Client) SendGroupMessage(group *Group, nonce *[24]byte, message []byte) []byte {
+	box := group.SealMessage(nonce, message)
+
+	c.mu.Lock()
+	handler := c.Handler
+	c.mu.Unlock()
+	if gh, ok := handler.(GroupHandler); ok {
+		gh.SentGroupMessage(group, message)
+	}
+	return box
+}
+
+// flushPendingGroupInvitesLocked returns and clears the group
+// invitations queued by SendGroupInvite since the last flush, assuming
+// c.mu is locked. Nothing in this package calls it (see the Group type's
+// doc comment), so queued invitations accumulate in
+// c.pendingGroupInvites rather than being silently discarded.
+func (c *Client) flushPendingGroupInvitesLocked() []*outgoingGroupInvite {
+	invites := c.pendingGroupInvites
+	c.pendingGroupInvites = nil
+	return invites
+}
+
+func persistedGroupFromGroup(g *Group) *persistedGroup {
+	return &persistedGroup{
+		Name:     g.Name,
+		GroupID:  g.GroupID[:],
+		Members:  g.Members,
+		GroupKey: g.groupKey[:],
+	}
+}
+
+func groupFromPersisted(pg *persistedGroup, client *Client) (*Group, error) {
+	if len(pg.GroupID) != sha256.Size || len(pg.GroupKey) != GroupKeySize {
+		return nil, fmt.Errorf("alpenhorn: malformed persisted group %q", pg.Name)
+	}
+	g := &Group{
+		Name:    pg.Name,
+		Members: pg.Members,
+		client:  client,
+	}
+	copy(g.GroupID[:], pg.GroupID)
+	copy(g.groupKey[:], pg.GroupKey)
+	return g, nil
+}
@@ -0,0 +1,161 @@
+// Copyright 2016 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+package alpenhorn
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"testing"
+
+	"vuvuzela.io/crypto/rand"
+)
+
+func TestGroupInvitationVerify(t *testing.T) {
+	creatorPub, creatorPriv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	g, err := NewGroup("book club", []string{"alice", "bob"}, "alice", creatorPriv)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	inv := g.invitation("alice", creatorPub, creatorPriv)
+	if err := inv.verify(); err != nil {
+		t.Fatalf("verify rejected a genuine invitation: %s", err)
+	}
+
+	tampered := *inv
+	tampered.Members = append([]string(nil), inv.Members...)
+	tampered.GroupKey[0] ^= 1
+	if err := tampered.verify(); err == nil {
+		t.Fatal("verify accepted an invitation with a tampered group key")
+	}
+
+	wrongSig := *inv
+	_, otherPriv, _ := ed25519.GenerateKey(rand.Reader)
+	wrongSig.Signature = ed25519.Sign(otherPriv, append([]byte(groupIDSigningContext), inv.GroupKey[:]...))
+	if err := wrongSig.verify(); err == nil {
+		t.Fatal("verify accepted an invitation signed by the wrong key")
+	}
+}
+
+func TestGroupSealOpenMessage(t *testing.T) {
+	_, creatorPriv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	g, err := NewGroup("book club", []string{"alice", "bob"}, "alice", creatorPriv)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var nonce [24]byte
+	box := g.SealMessage(&nonce, []byte("see you at 7"))
+
+	opened, ok := g.OpenMessage(&nonce, box)
+	if !ok {
+		t.Fatal("OpenMessage failed to open a message sealed by the same group")
+	}
+	if !bytes.Equal(opened, []byte("see you at 7")) {
+		t.Fatalf("got %q, want %q", opened, "see you at 7")
+	}
+
+	other, err := NewGroup("other group", []string{"carol"}, "carol", creatorPriv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := other.OpenMessage(&nonce, box); ok {
+		t.Fatal("a different group's key opened this group's message")
+	}
+}
+
+type spyGroupHandler struct {
+	receivedInvite   *Group
+	receivedMessages [][]byte
+	sentMessages     [][]byte
+}
+
+func (h *spyGroupHandler) ReceivedGroupInvite(group *Group) {
+	h.receivedInvite = group
+}
+func (h *spyGroupHandler) ReceivedGroupMessage(group *Group, message []byte) {
+	h.receivedMessages = append(h.receivedMessages, message)
+}
+func (h *spyGroupHandler) SentGroupMessage(group *Group, message []byte) {
+	h.sentMessages = append(h.sentMessages, message)
+}
+
+func TestReceivedGroupInviteNotifiesGroupHandler(t *testing.T) {
+	creatorPub, creatorPriv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	g, err := NewGroup("book club", []string{"alice", "bob"}, "alice", creatorPriv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	inv := g.invitation("alice", creatorPub, creatorPriv)
+
+	handler := &spyGroupHandler{}
+	c := &Client{Username: "bob", Handler: handler}
+	got, err := c.ReceivedGroupInvite(inv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if handler.receivedInvite != got {
+		t.Fatal("ReceivedGroupInvite did not notify the GroupHandler with the new group")
+	}
+}
+
+func TestSendAndReceiveGroupMessageNotifyGroupHandler(t *testing.T) {
+	_, creatorPriv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	g, err := NewGroup("book club", []string{"alice", "bob"}, "alice", creatorPriv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	g.client = &Client{Username: "alice", Handler: &spyGroupHandler{}}
+
+	var nonce [24]byte
+	box := g.client.SendGroupMessage(g, &nonce, []byte("see you at 7"))
+	sent := g.client.Handler.(*spyGroupHandler)
+	if len(sent.sentMessages) != 1 || string(sent.sentMessages[0]) != "see you at 7" {
+		t.Fatalf("SendGroupMessage did not notify SentGroupMessage: %v", sent.sentMessages)
+	}
+
+	recvHandler := &spyGroupHandler{}
+	recvClient := &Client{Username: "bob", Handler: recvHandler}
+	if _, err := recvClient.ReceivedGroupMessage(g, &nonce, box); err != nil {
+		t.Fatal(err)
+	}
+	if len(recvHandler.receivedMessages) != 1 || string(recvHandler.receivedMessages[0]) != "see you at 7" {
+		t.Fatalf("ReceivedGroupMessage did not notify ReceivedGroupMessage: %v", recvHandler.receivedMessages)
+	}
+}
+
+func TestReceivedGroupInviteRejectsInvalidSignature(t *testing.T) {
+	creatorPub, creatorPriv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	g, err := NewGroup("book club", []string{"alice", "bob"}, "alice", creatorPriv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	inv := g.invitation("alice", creatorPub, creatorPriv)
+	inv.Signature[0] ^= 1
+
+	c := &Client{Username: "bob"}
+	if _, err := c.ReceivedGroupInvite(inv); err == nil {
+		t.Fatal("ReceivedGroupInvite accepted an invitation with a corrupted signature")
+	}
+	if len(c.groups) != 0 {
+		t.Fatal("a rejected invitation was added to c.groups anyway")
+	}
+}
@@ -0,0 +1,215 @@
+// Copyright 2016 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+package alpenhorn
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// invitationTokenEncoding is the base32 alphabet used for invitation
+// tokens; padding is dropped since the encoded length is known from the
+// decoded JSON itself.
+var invitationTokenEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// invitationSigningContext domain-separates invitation signatures from
+// other uses of a user's long-term key, following the convention used
+// elsewhere in alpenhorn (see groupIDSigningContext).
+const invitationSigningContext = "AlpenhornInvitation"
+
+// Invitation is a signed, offline-shareable claim that a user controls a
+// given username and long-term key. Alice creates one with
+// Client.CreateInvitation and shares its Token out-of-band (a QR code, a
+// messenger link); Bob turns it back into a pending friend request with
+// Client.RedeemInvitation without needing Alice online at the time.
+//easyjson:readable
+type Invitation struct {
+	Username          string
+	LongTermPublicKey ed25519.PublicKey
+	ExtraData         []byte
+	NotAfter          time.Time
+	Signature         []byte
+}
+
+// CreateInvitation creates an Invitation for this client's own username
+// and long-term key, valid until notAfter. Share the result's Token with
+// whoever should be able to redeem it.
+func (c *Client) CreateInvitation(notAfter time.Time, extraData []byte) (*Invitation, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	inv := &Invitation{
+		Username:          c.Username,
+		LongTermPublicKey: c.LongTermPublicKey,
+		ExtraData:         extraData,
+		NotAfter:          notAfter,
+	}
+	inv.Signature = ed25519.Sign(c.LongTermPrivateKey, inv.signedData())
+	return inv, nil
+}
+
+// Token encodes inv as a signed, base32 string suitable for sharing
+// out-of-band. Use RedeemInvitation to turn a token back into a pending
+// friend request.
+func (inv *Invitation) Token() (string, error) {
+	data, err := json.Marshal(inv)
+	if err != nil {
+		return "", err
+	}
+	return invitationTokenEncoding.EncodeToString(data), nil
+}
+
+// parseInvitationToken decodes a token produced by Invitation.Token.
+// It does not verify the invitation's signature or expiry; see verify.
+func parseInvitationToken(token string) (*Invitation, error) {
+	data, err := invitationTokenEncoding.DecodeString(token)
+	if err != nil {
+		return nil, fmt.Errorf("alpenhorn: malformed invitation token: %s", err)
+	}
+	inv := new(Invitation)
+	if err := json.Unmarshal(data, inv); err != nil {
+		return nil, fmt.Errorf("alpenhorn: malformed invitation token: %s", err)
+	}
+	return inv, nil
+}
+
+// signedData is what Signature signs over: Username, ExtraData and
+// NotAfter, after invitationSigningContext. LongTermPublicKey is not
+// part of these bytes; it is the key Signature must verify under.
+// Username and ExtraData are each preceded by their length so that,
+// e.g., Username="ali"/ExtraData="ce" can't be repackaged as
+// Username="alice"/ExtraData="" and verify against the same signature.
+// NotAfter is encoded in UTC, so the bytes are the same before and after
+// a round trip through Token, which can change its time zone location.
+func (inv *Invitation) signedData() []byte {
+	notAfter, _ := inv.NotAfter.UTC().MarshalBinary()
+
+	buf := make([]byte, 0, len(invitationSigningContext)+8+len(inv.Username)+len(inv.ExtraData)+len(notAfter))
+	buf = append(buf, invitationSigningContext...)
+	buf = appendUint32LenPrefixed(buf, []byte(inv.Username))
+	buf = appendUint32LenPrefixed(buf, inv.ExtraData)
+	buf = append(buf, notAfter...)
+	return buf
+}
+
+func appendUint32LenPrefixed(buf, data []byte) []byte {
+	var length [4]byte
+	binary.BigEndian.PutUint32(length[:], uint32(len(data)))
+	buf = append(buf, length[:]...)
+	return append(buf, data...)
+}
+
+// verify checks that inv hasn't expired and that Signature was produced
+// by LongTermPublicKey. It does not check that LongTermPublicKey is
+// actually the key the PKG has on file for Username; that's RedeemInvitation's job.
+func (inv *Invitation) verify() error {
+	if !time.Now().Before(inv.NotAfter) {
+		return errors.New("alpenhorn: invitation has expired")
+	}
+	if !ed25519.Verify(inv.LongTermPublicKey, inv.signedData(), inv.Signature) {
+		return errors.New("alpenhorn: invalid invitation signature")
+	}
+	return nil
+}
+
+// PKGLookupFunc looks up the long-term key the PKG currently attests for
+// username, as a one-shot request independent of any round. Set a
+// Client's PKGLookup field to one before calling RedeemInvitation.
+//
+// TODO: provide a default implementation that queries
+// c.addFriendConfig.PKGServers over edhttp, the way Client.Register
+// does, so callers don't all have to write their own; until then,
+// callers must supply one.
+type PKGLookupFunc func(username string) (ed25519.PublicKey, error)
+
+// RedeemInvitation verifies token, confirms with a one-shot PKGLookup
+// call that the username it claims is still attested by the PKG to own
+// the stated long-term key (so a token alone, e.g. one leaked after
+// Alice rotated her key, can't be used to impersonate her), and, if
+// both checks pass, sends Username a friend request whose ExtraData is
+// the invitation token itself.
+//
+// Because Alice signed that token with her own long-term key, her
+// client can recognize it coming back as the ExtraData on an incoming
+// friend request: call AutoApproveInvitedFriend from the Handler's
+// ReceivedFriendRequest callback, before presenting any approval UI, to
+// approve it immediately instead of treating it like a request from a
+// stranger.
+//
+// RedeemInvitation requires c.PKGLookup to be set; it returns an error
+// otherwise rather than silently skipping the PKG-attestation check.
+func (c *Client) RedeemInvitation(token string) (*OutgoingFriendRequest, error) {
+	inv, err := parseInvitationToken(token)
+	if err != nil {
+		return nil, err
+	}
+	if err := inv.verify(); err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	lookup := c.PKGLookup
+	c.mu.Unlock()
+	if lookup == nil {
+		return nil, errors.New("alpenhorn: Client.PKGLookup must be set before calling RedeemInvitation")
+	}
+
+	attestedKey, err := lookup(inv.Username)
+	if err != nil {
+		return nil, fmt.Errorf("alpenhorn: looking up %q: %s", inv.Username, err)
+	}
+	if !bytes.Equal(attestedKey, inv.LongTermPublicKey) {
+		return nil, errors.New("alpenhorn: invitation key does not match the PKG-attested key")
+	}
+
+	c.mu.Lock()
+	c.pendingInvitations = append(c.pendingInvitations, inv)
+	err = c.persistClientLocked()
+	c.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	return c.SendFriendRequest(inv.Username, []byte(token))
+}
+
+// AutoApproveInvitedFriend approves req immediately, instead of leaving
+// it for the application to show an approval dialog for, if proof is an
+// invitation token this client itself issued via CreateInvitation: it
+// must parse as an Invitation naming this client's own Username and
+// LongTermPublicKey, and its signature must verify. A token names no
+// recipient, so it is accepted from whichever sender presents it.
+// Call this with req's ExtraData from the Handler's
+// ReceivedFriendRequest callback, before presenting any UI; it reports
+// whether it auto-approved req so the caller can fall back to the
+// normal dialog otherwise.
+func (c *Client) AutoApproveInvitedFriend(req *IncomingFriendRequest, proof []byte) (bool, error) {
+	inv, err := parseInvitationToken(string(proof))
+	if err != nil {
+		return false, nil
+	}
+
+	c.mu.Lock()
+	username, myKey := c.Username, c.LongTermPublicKey
+	c.mu.Unlock()
+
+	if inv.Username != username || !bytes.Equal(inv.LongTermPublicKey, myKey) {
+		return false, nil
+	}
+	if err := inv.verify(); err != nil {
+		return false, nil
+	}
+
+	if _, err := req.Approve(); err != nil {
+		return false, err
+	}
+	return true, nil
+}
@@ -0,0 +1,166 @@
+// Copyright 2016 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+package alpenhorn
+
+import (
+	"crypto/ed25519"
+	"testing"
+	"time"
+
+	"vuvuzela.io/crypto/rand"
+)
+
+func TestInvitationTokenRoundTrip(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	inv := &Invitation{
+		Username:          "alice",
+		LongTermPublicKey: pub,
+		ExtraData:         []byte("hello bob"),
+		NotAfter:          time.Now().Add(time.Hour),
+	}
+	inv.Signature = ed25519.Sign(priv, inv.signedData())
+
+	token, err := inv.Token()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := parseInvitationToken(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := got.verify(); err != nil {
+		t.Fatalf("verify failed on a round-tripped invitation: %s", err)
+	}
+	if got.Username != inv.Username {
+		t.Fatalf("got username %q, want %q", got.Username, inv.Username)
+	}
+}
+
+func TestInvitationExpired(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	inv := &Invitation{
+		Username:          "alice",
+		LongTermPublicKey: pub,
+		NotAfter:          time.Now().Add(-time.Minute),
+	}
+	inv.Signature = ed25519.Sign(priv, inv.signedData())
+
+	if err := inv.verify(); err == nil {
+		t.Fatal("verify accepted an expired invitation")
+	}
+}
+
+// TestInvitationSignatureBindsFieldBoundary guards against signedData
+// concatenating Username and ExtraData without a boundary: without the
+// length prefix, Username="ali"+ExtraData="ce" and Username="alice"+
+// ExtraData="" produce the same signed bytes, so a signature for one
+// would verify for the other.
+func TestInvitationSignatureBindsFieldBoundary(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	notAfter := time.Now().Add(time.Hour)
+
+	a := &Invitation{Username: "ali", LongTermPublicKey: pub, ExtraData: []byte("ce"), NotAfter: notAfter}
+	a.Signature = ed25519.Sign(priv, a.signedData())
+
+	b := &Invitation{Username: "alice", LongTermPublicKey: pub, ExtraData: nil, NotAfter: notAfter}
+	b.Signature = a.Signature
+
+	if err := b.verify(); err == nil {
+		t.Fatal("a signature over Username+ExtraData verified after re-splitting the boundary between them")
+	}
+}
+
+func TestRedeemInvitationRequiresPKGLookup(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	inv := &Invitation{
+		Username:          "alice",
+		LongTermPublicKey: pub,
+		NotAfter:          time.Now().Add(time.Hour),
+	}
+	inv.Signature = ed25519.Sign(priv, inv.signedData())
+	token, err := inv.Token()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := &Client{Username: "bob"}
+	if _, err := c.RedeemInvitation(token); err == nil {
+		t.Fatal("RedeemInvitation succeeded without a PKGLookup set")
+	}
+}
+
+func TestAutoApproveInvitedFriendRejectsWrongUsername(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	inv := &Invitation{Username: "someone-else", LongTermPublicKey: pub, NotAfter: time.Now().Add(time.Hour)}
+	inv.Signature = ed25519.Sign(priv, inv.signedData())
+	token, err := inv.Token()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := &Client{Username: "alice", LongTermPublicKey: pub}
+	req := &IncomingFriendRequest{Username: "bob"}
+	ok, err := c.AutoApproveInvitedFriend(req, []byte(token))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok {
+		t.Fatal("auto-approved a token that was issued for a different username")
+	}
+}
+
+func TestAutoApproveInvitedFriendRejectsBadSignature(t *testing.T) {
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	inv := &Invitation{Username: "alice", LongTermPublicKey: pub, NotAfter: time.Now().Add(time.Hour)}
+	inv.Signature = make([]byte, ed25519.SignatureSize) // never actually signed
+
+	token, err := inv.Token()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := &Client{Username: "alice", LongTermPublicKey: pub}
+	req := &IncomingFriendRequest{Username: "bob"}
+	ok, err := c.AutoApproveInvitedFriend(req, []byte(token))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok {
+		t.Fatal("auto-approved a token with an invalid signature")
+	}
+}
+
+func TestAutoApproveInvitedFriendIgnoresNonInvitationExtraData(t *testing.T) {
+	c := &Client{Username: "alice"}
+	req := &IncomingFriendRequest{Username: "bob"}
+	ok, err := c.AutoApproveInvitedFriend(req, []byte("just a plain note, not a token"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok {
+		t.Fatal("treated arbitrary ExtraData as an invitation proof")
+	}
+}
@@ -0,0 +1,66 @@
+// Copyright 2016 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+package alpenhorn
+
+import (
+	log "github.com/sirupsen/logrus"
+)
+
+// Fields are structured key/value pairs attached to a single log entry.
+type Fields map[string]interface{}
+
+// Logger is the logging interface used by Client. Applications that
+// embed alpenhorn (for example, a GUI client) can implement Logger to
+// route the client's diagnostics into their own log pipeline instead of
+// alpenhorn's default logrus output, or to suppress them entirely.
+// coordinator.Server and pkg.Server do not take a Logger.
+//
+// A Client with a nil Logger field falls back to defaultLogger, a
+// logrus-backed adapter, so existing code that never sets Logger keeps
+// logging exactly as before.
+type Logger interface {
+	Debug(args ...interface{})
+	Info(args ...interface{})
+	Warn(args ...interface{})
+	Error(args ...interface{})
+
+	// WithFields returns a Logger that annotates every entry it logs
+	// with fields, in addition to whatever this Logger already adds.
+	WithFields(fields Fields) Logger
+}
+
+// logrusLogger adapts the package-global logrus logger to the Logger
+// interface. It's the default used when a Logger field is left nil.
+type logrusLogger struct {
+	entry *log.Entry
+}
+
+// defaultLogger is used wherever a *Client has a nil Logger field, so
+// that the zero value of Client behaves the way alpenhorn always has.
+var defaultLogger Logger = logrusLogger{entry: log.NewEntry(log.StandardLogger())}
+
+func (l logrusLogger) Debug(args ...interface{}) { l.entry.Debug(args...) }
+func (l logrusLogger) Info(args ...interface{})  { l.entry.Info(args...) }
+func (l logrusLogger) Warn(args ...interface{})  { l.entry.Warn(args...) }
+func (l logrusLogger) Error(args ...interface{}) { l.entry.Error(args...) }
+
+func (l logrusLogger) WithFields(fields Fields) Logger {
+	return logrusLogger{entry: l.entry.WithFields(log.Fields(fields))}
+}
+
+// logger returns c.Logger, or defaultLogger if it's unset.
+//
+// TODO: thread a Logger field through coordinator.Server and pkg.Server
+// the same way, and replace their log.Fatalf call sites with returned
+// errors (plus an opt-in PanicOnBootstrapError flag for callers that
+// want today's fail-fast behavior), so an embedding application can
+// route every alpenhorn log line through one sink instead of just the
+// client's.
+func (c *Client) logger() Logger {
+	if c.Logger != nil {
+		return c.Logger
+	}
+	return defaultLogger
+}
@@ -0,0 +1,55 @@
+// Copyright 2016 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+package alpenhorn
+
+import "testing"
+
+type recordingLogger struct {
+	warnings *[]string
+}
+
+func (l recordingLogger) Debug(args ...interface{}) {}
+func (l recordingLogger) Info(args ...interface{})  {}
+func (l recordingLogger) Error(args ...interface{}) {}
+func (l recordingLogger) Warn(args ...interface{}) {
+	*l.warnings = append(*l.warnings, fmtArgs(args))
+}
+func (l recordingLogger) WithFields(Fields) Logger { return l }
+
+func fmtArgs(args []interface{}) string {
+	s := ""
+	for _, a := range args {
+		if v, ok := a.(string); ok {
+			s += v
+		}
+	}
+	return s
+}
+
+func TestClientLoggerDefaultsToLogrus(t *testing.T) {
+	c := &Client{}
+	if _, ok := c.logger().(logrusLogger); !ok {
+		t.Fatalf("logger() returned %T with no Logger set, want logrusLogger", c.logger())
+	}
+}
+
+func TestLoadStateWarnsOnMalformedGroup(t *testing.T) {
+	var warnings []string
+	c := &Client{Logger: recordingLogger{warnings: &warnings}}
+
+	st := &persistedState{
+		Groups: map[string]*persistedGroup{
+			"broken": {Name: "broken", GroupID: []byte("too short")},
+		},
+	}
+	c.loadStateLocked(st)
+
+	if len(warnings) == 0 {
+		t.Fatal("loadStateLocked did not log a warning for a malformed group")
+	}
+	if len(c.groups) != 0 {
+		t.Fatalf("malformed group was loaded anyway: %v", c.groups)
+	}
+}
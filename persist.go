@@ -6,11 +6,9 @@ package alpenhorn
 
 import (
 	"crypto/ed25519"
-	"encoding/json"
-	"io/ioutil"
+	"fmt"
 
 	"vuvuzela.io/alpenhorn/config"
-	"vuvuzela.io/internal/ioutil2"
 )
 
 //easyjson:readable
@@ -27,6 +25,11 @@ type persistedState struct {
 	OutgoingFriendRequests []*OutgoingFriendRequest
 	SentFriendRequests     []*sentFriendRequest
 	Friends                map[string]*persistedFriend
+
+	Groups              map[string]*persistedGroup
+	PendingGroupInvites []*outgoingGroupInvite
+
+	PendingInvitations []*Invitation
 }
 
 // persistedFriend is the persisted representation of the Friend type.
@@ -38,28 +41,26 @@ type persistedFriend struct {
 	ExtraData   []byte
 }
 
-// LoadClient loads a client from persisted state at the given path.
+// LoadClient loads a client from the legacy JSON file persistence format
+// at clientPersistPath and keywheelPersistPath. Pass the passphrase the
+// files were previously saved with, or the empty string if they are
+// unencrypted; LoadClient auto-detects which format is on disk. Use
+// LoadClientFromStore to load a profile from a different ProfileStore,
+// such as a BoltStore.
 // You should set the client's KeywheelPersistPath before connecting.
-func LoadClient(clientPersistPath, keywheelPersistPath string) (*Client, error) {
-	clientData, err := ioutil.ReadFile(clientPersistPath)
-	if err != nil {
-		return nil, err
-	}
-
-	st := new(persistedState)
-	err = json.Unmarshal(clientData, st)
-	if err != nil {
-		return nil, err
-	}
+func LoadClient(clientPersistPath, keywheelPersistPath, passphrase string) (*Client, error) {
+	return LoadClientFromStore(NewJSONFileStore(clientPersistPath, keywheelPersistPath, passphrase))
+}
 
-	keywheelData, err := ioutil.ReadFile(keywheelPersistPath)
+// LoadClientFromStore loads a client's profile from store.
+func LoadClientFromStore(store ProfileStore) (*Client, error) {
+	st, keywheelData, err := store.Load()
 	if err != nil {
 		return nil, err
 	}
 
 	c := &Client{
-		ClientPersistPath:   clientPersistPath,
-		KeywheelPersistPath: keywheelPersistPath,
+		store: store,
 	}
 	err = c.wheel.UnmarshalBinary(keywheelData)
 	if err != nil {
@@ -105,6 +106,35 @@ func (c *Client) loadStateLocked(st *persistedState) {
 			client:      c,
 		}
 	}
+
+	c.groups = make(map[string]*Group, len(st.Groups))
+	for name, pg := range st.Groups {
+		g, err := groupFromPersisted(pg, c)
+		if err != nil {
+			// Skip malformed groups rather than failing to load the
+			// whole profile over one bad entry.
+			c.logger().WithFields(Fields{"group": name}).Warn("skipping malformed persisted group: ", err)
+			continue
+		}
+		c.groups[name] = g
+	}
+	c.pendingGroupInvites = st.PendingGroupInvites
+	c.pendingInvitations = st.PendingInvitations
+}
+
+// profileStore returns the ProfileStore the client should persist to. It
+// defaults to a JSON file store built from ClientPersistPath and
+// KeywheelPersistPath so that existing code that sets those fields
+// directly keeps working without constructing a store explicitly. That
+// default store is cached in c.store the first time it's needed, so
+// later calls (in particular ChangePassphrase) all act on the same
+// instance instead of each rebuilding a throwaway one from the
+// possibly-stale c.passphrase field.
+func (c *Client) profileStore() ProfileStore {
+	if c.store == nil {
+		c.store = NewJSONFileStore(c.ClientPersistPath, c.KeywheelPersistPath, c.passphrase)
+	}
+	return c.store
 }
 
 // Persist writes the client's state to disk. The client persists
@@ -135,16 +165,14 @@ func (c *Client) persistClient() error {
 	return err
 }
 
-func (c *Client) persistClientLocked() error {
-	if c.ClientPersistPath == "" {
-		return nil
-	}
-
+// stateLocked builds the persistedState snapshot of c, assuming c.mu is
+// locked.
+func (c *Client) stateLocked() *persistedState {
 	st := &persistedState{
 		Username:           c.Username,
 		LongTermPublicKey:  c.LongTermPublicKey,
-		LongTermPrivateKey: c.LongTermPrivateKey,
-		PKGLoginKey:        c.PKGLoginKey,
+		LongTermPrivateKey: clonePrivateKey(c.LongTermPrivateKey),
+		PKGLoginKey:        clonePrivateKey(c.PKGLoginKey),
 
 		AddFriendConfig: c.addFriendConfig,
 		DialingConfig:   c.dialingConfig,
@@ -154,6 +182,11 @@ func (c *Client) persistClientLocked() error {
 		SentFriendRequests:     c.sentFriendRequests,
 
 		Friends: make(map[string]*persistedFriend, len(c.friends)),
+
+		Groups:              make(map[string]*persistedGroup, len(c.groups)),
+		PendingGroupInvites: c.pendingGroupInvites,
+
+		PendingInvitations: c.pendingInvitations,
 	}
 
 	for username, friend := range c.friends {
@@ -164,12 +197,56 @@ func (c *Client) persistClientLocked() error {
 		}
 	}
 
-	data, err := json.MarshalIndent(st, "", "  ")
-	if err != nil {
-		return err
+	for name, g := range c.groups {
+		st.Groups[name] = persistedGroupFromGroup(g)
+	}
+
+	return st
+}
+
+func (c *Client) persistClientLocked() error {
+	st := c.stateLocked()
+	err := c.profileStore().SaveClient(st)
+
+	// The marshaled state above is the only other copy of the private
+	// key material outside of the Client struct itself; scrub it now
+	// that it has been written (or failed to write) to the store.
+	zero(st.LongTermPrivateKey)
+	zero(st.PKGLoginKey)
+
+	return err
+}
+
+// persistFriendLocked persists a single friend, assuming c.mu is locked.
+// Stores that support it (see ProfileStore.SaveFriend) update only that
+// friend's record instead of rewriting the whole profile, which matters
+// once the friend list is large; see also deleteFriendLocked.
+func (c *Client) persistFriendLocked(username string) error {
+	friend, ok := c.friends[username]
+	if !ok {
+		return fmt.Errorf("alpenhorn: no such friend: %q", username)
 	}
+	return c.profileStore().SaveFriend(username, &persistedFriend{
+		Username:    friend.Username,
+		LongTermKey: friend.LongTermKey,
+		ExtraData:   friend.extraData,
+	})
+}
+
+// deleteFriendLocked removes username from the client's in-memory state
+// and from the profile store, assuming c.mu is locked.
+func (c *Client) deleteFriendLocked(username string) error {
+	delete(c.friends, username)
+	return c.profileStore().DeleteFriend(username)
+}
 
-	return ioutil2.WriteFileAtomic(c.ClientPersistPath, data, 0600)
+// persistIncomingRequestLocked persists the client's friend request
+// state after a change to the incoming request identified by id,
+// assuming c.mu is locked. Friend requests are comparatively low-volume
+// control state, so unlike persistFriendLocked this still goes through
+// the same full-profile write as the rest of the client record.
+func (c *Client) persistIncomingRequestLocked(id string) error {
+	return c.persistClientLocked()
 }
 
 func (c *Client) persistKeywheel() error {
@@ -180,14 +257,48 @@ func (c *Client) persistKeywheel() error {
 }
 
 func (c *Client) persistKeywheelLocked() error {
-	if c.KeywheelPersistPath == "" {
-		return nil
-	}
-
 	data, err := c.wheel.MarshalBinary()
 	if err != nil {
 		return err
 	}
 
-	return ioutil2.WriteFileAtomic(c.KeywheelPersistPath, data, 0600)
+	return c.profileStore().SaveKeywheel(data)
+}
+
+// ChangePassphrase re-encrypts the client's persisted state and keywheel
+// under a new passphrase. The bolt driver re-encrypts both in a single
+// transaction. The JSON file driver replaces the client file and then
+// the keywheel file, each atomically, so an error or crash between the
+// two writes leaves the files under different passphrases. Use the empty
+// string for newPassphrase to switch back to the unencrypted format. If
+// old does not match the passphrase currently protecting the persisted
+// files, ChangePassphrase fails and leaves the on-disk state untouched.
+// It returns an error if the client's ProfileStore driver doesn't
+// support changing passphrases in place.
+func (c *Client) ChangePassphrase(old, newPassphrase string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	store := c.profileStore()
+	pc, ok := store.(passphraseChanger)
+	if !ok {
+		return fmt.Errorf("alpenhorn: %T does not support changing passphrases", store)
+	}
+	if err := pc.changePassphrase(old, newPassphrase); err != nil {
+		return err
+	}
+
+	// Keep c.passphrase in sync with the store: profileStore falls back
+	// to reading it only when c.store hasn't been set explicitly, but it
+	// must still reflect reality for that path (and for callers that
+	// inspect it directly).
+	c.passphrase = newPassphrase
+	return nil
+}
+
+// passphraseChanger is implemented by ProfileStore drivers that can
+// re-encrypt their data under a new passphrase in place, such as
+// jsonFileStore and boltStore.
+type passphraseChanger interface {
+	changePassphrase(old, newPassphrase string) error
 }
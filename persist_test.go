@@ -0,0 +1,106 @@
+// Copyright 2016 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+package alpenhorn
+
+import "testing"
+
+// spyStore is a ProfileStore that records which of its methods were
+// called, so tests can tell a scoped write (SaveFriend, DeleteFriend)
+// from a full-profile rewrite (SaveClient) without touching disk.
+type spyStore struct {
+	saveClientCalls int
+	savedFriends    map[string]*persistedFriend
+	deletedFriends  []string
+}
+
+func (s *spyStore) Load() (*persistedState, []byte, error) {
+	return &persistedState{}, nil, nil
+}
+
+func (s *spyStore) SaveClient(st *persistedState) error {
+	s.saveClientCalls++
+	return nil
+}
+
+func (s *spyStore) SaveKeywheel(data []byte) error { return nil }
+
+func (s *spyStore) SaveFriend(username string, friend *persistedFriend) error {
+	if s.savedFriends == nil {
+		s.savedFriends = make(map[string]*persistedFriend)
+	}
+	s.savedFriends[username] = friend
+	return nil
+}
+
+func (s *spyStore) DeleteFriend(username string) error {
+	s.deletedFriends = append(s.deletedFriends, username)
+	return nil
+}
+
+func (s *spyStore) Close() error { return nil }
+
+func TestPersistFriendLockedSavesOnlyThatFriend(t *testing.T) {
+	store := &spyStore{}
+	c := &Client{
+		store: store,
+		friends: map[string]*Friend{
+			"bob": {Username: "bob", extraData: []byte("note")},
+		},
+	}
+
+	if err := c.persistFriendLocked("bob"); err != nil {
+		t.Fatal(err)
+	}
+
+	saved := store.savedFriends["bob"]
+	if saved == nil {
+		t.Fatal("persistFriendLocked did not call SaveFriend for bob")
+	}
+	if saved.Username != "bob" || string(saved.ExtraData) != "note" {
+		t.Fatalf("got %+v, want Username bob, ExtraData \"note\"", saved)
+	}
+	if store.saveClientCalls != 0 {
+		t.Fatalf("persistFriendLocked rewrote the whole profile (%d SaveClient calls)", store.saveClientCalls)
+	}
+}
+
+func TestPersistFriendLockedUnknownFriend(t *testing.T) {
+	c := &Client{store: &spyStore{}, friends: map[string]*Friend{}}
+	if err := c.persistFriendLocked("bob"); err == nil {
+		t.Fatal("persistFriendLocked succeeded for a friend that doesn't exist")
+	}
+}
+
+func TestDeleteFriendLockedRemovesFromMemoryAndStore(t *testing.T) {
+	store := &spyStore{}
+	c := &Client{
+		store: store,
+		friends: map[string]*Friend{
+			"bob": {Username: "bob"},
+		},
+	}
+
+	if err := c.deleteFriendLocked("bob"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := c.friends["bob"]; ok {
+		t.Fatal("deleteFriendLocked left bob in c.friends")
+	}
+	if len(store.deletedFriends) != 1 || store.deletedFriends[0] != "bob" {
+		t.Fatalf("got DeleteFriend calls %v, want [\"bob\"]", store.deletedFriends)
+	}
+}
+
+func TestPersistIncomingRequestLockedRewritesFullProfile(t *testing.T) {
+	store := &spyStore{}
+	c := &Client{store: store}
+
+	if err := c.persistIncomingRequestLocked("some-request-id"); err != nil {
+		t.Fatal(err)
+	}
+	if store.saveClientCalls != 1 {
+		t.Fatalf("got %d SaveClient calls, want 1", store.saveClientCalls)
+	}
+}
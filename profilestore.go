@@ -0,0 +1,209 @@
+// Copyright 2016 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+package alpenhorn
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+
+	"vuvuzela.io/internal/ioutil2"
+)
+
+// ProfileStore is the persistence backend for a Client's profile: the
+// client's own state, its keywheel, and its friends. The default driver,
+// returned by NewJSONFileStore, is a pair of files that are rewritten in
+// full on every save. NewBoltStore is a BoltDB-backed driver that saves
+// and deletes individual friends without rewriting the rest of the
+// profile, which matters once the friend list is large.
+type ProfileStore interface {
+	// Load reads the full client state, including all friends, and the
+	// raw keywheel bytes.
+	Load() (*persistedState, []byte, error)
+
+	// SaveClient persists everything in st. Drivers that store friends
+	// independently (see SaveFriend) are free to ignore st.Friends.
+	SaveClient(st *persistedState) error
+
+	// SaveKeywheel persists the marshaled keywheel.
+	SaveKeywheel(data []byte) error
+
+	// SaveFriend persists a single friend without rewriting the rest of
+	// the profile, if the driver is able to.
+	SaveFriend(username string, friend *persistedFriend) error
+
+	// DeleteFriend removes a single friend from the store.
+	DeleteFriend(username string) error
+
+	Close() error
+}
+
+// jsonFileStore is the original ProfileStore: the client state and the
+// keywheel are each a single file that is rewritten in full on every
+// save. It's kept as a driver for backward compatibility and as the
+// source format for Migrate.
+type jsonFileStore struct {
+	clientPath   string
+	keywheelPath string
+	passphrase   string
+}
+
+// NewJSONFileStore returns a ProfileStore that persists the client state
+// and keywheel to clientPath and keywheelPath respectively. If
+// passphrase is non-empty, both files are sealed; see seal.go.
+func NewJSONFileStore(clientPath, keywheelPath, passphrase string) ProfileStore {
+	return &jsonFileStore{
+		clientPath:   clientPath,
+		keywheelPath: keywheelPath,
+		passphrase:   passphrase,
+	}
+}
+
+func (s *jsonFileStore) Load() (*persistedState, []byte, error) {
+	clientData, err := ioutil.ReadFile(s.clientPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	clientData, err = maybeUnseal(clientData, s.passphrase)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error reading %s: %s", s.clientPath, err)
+	}
+
+	st := new(persistedState)
+	if err := json.Unmarshal(clientData, st); err != nil {
+		return nil, nil, err
+	}
+
+	keywheelData, err := ioutil.ReadFile(s.keywheelPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	keywheelData, err = maybeUnseal(keywheelData, s.passphrase)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error reading %s: %s", s.keywheelPath, err)
+	}
+
+	return st, keywheelData, nil
+}
+
+func (s *jsonFileStore) SaveClient(st *persistedState) error {
+	if s.clientPath == "" {
+		return nil
+	}
+
+	data, err := json.MarshalIndent(st, "", "  ")
+	if err != nil {
+		return err
+	}
+	if s.passphrase != "" {
+		data, err = seal(data, s.passphrase)
+		if err != nil {
+			return err
+		}
+	}
+	return ioutil2.WriteFileAtomic(s.clientPath, data, 0600)
+}
+
+func (s *jsonFileStore) SaveKeywheel(data []byte) error {
+	if s.keywheelPath == "" {
+		return nil
+	}
+
+	var err error
+	if s.passphrase != "" {
+		data, err = seal(data, s.passphrase)
+		if err != nil {
+			return err
+		}
+	}
+	return ioutil2.WriteFileAtomic(s.keywheelPath, data, 0600)
+}
+
+// SaveFriend rewrites the entire client file, since the JSON format has
+// no way to update a single friend in isolation. Use a BoltStore instead
+// if the friend list is large enough for this to matter.
+func (s *jsonFileStore) SaveFriend(username string, friend *persistedFriend) error {
+	st, _, err := s.Load()
+	if err != nil {
+		return err
+	}
+	if st.Friends == nil {
+		st.Friends = make(map[string]*persistedFriend, 1)
+	}
+	st.Friends[username] = friend
+	return s.SaveClient(st)
+}
+
+func (s *jsonFileStore) DeleteFriend(username string) error {
+	st, _, err := s.Load()
+	if err != nil {
+		return err
+	}
+	delete(st.Friends, username)
+	return s.SaveClient(st)
+}
+
+func (s *jsonFileStore) Close() error {
+	return nil
+}
+
+func (s *jsonFileStore) changePassphrase(old, newPassphrase string) error {
+	if old != s.passphrase {
+		return fmt.Errorf("alpenhorn: wrong passphrase")
+	}
+
+	st, keywheelData, err := s.Load()
+	if err != nil {
+		return err
+	}
+
+	prev := s.passphrase
+	s.passphrase = newPassphrase
+	if err := s.SaveClient(st); err != nil {
+		s.passphrase = prev
+		return err
+	}
+	if err := s.SaveKeywheel(keywheelData); err != nil {
+		s.passphrase = prev
+		return err
+	}
+	return nil
+}
+
+// Migrate copies a profile out of the legacy JSON file format and into
+// newStore. It's meant to be invoked once, the first time a profile
+// created before ProfileStore existed is opened with a different
+// driver.
+func Migrate(oldClientPath, oldKeywheelPath, passphrase string, newStore ProfileStore) error {
+	old := NewJSONFileStore(oldClientPath, oldKeywheelPath, passphrase)
+
+	st, keywheelData, err := old.Load()
+	if err != nil {
+		return err
+	}
+
+	// SaveClient first, with st.Friends still populated: newStore might
+	// be a driver like jsonFileStore that has no separate friends
+	// storage and just marshals st.Friends verbatim, so leaving it
+	// populated here is what keeps friends from being silently dropped
+	// on such a destination. The SaveFriend calls below are then the
+	// real population step for drivers like boltStore that keep friends
+	// in their own rows, and a harmless redundant rewrite for drivers
+	// that already embedded them above.
+	friends := st.Friends
+	if err := newStore.SaveClient(st); err != nil {
+		return err
+	}
+	if err := newStore.SaveKeywheel(keywheelData); err != nil {
+		return err
+	}
+
+	for username, friend := range friends {
+		if err := newStore.SaveFriend(username, friend); err != nil {
+			return err
+		}
+	}
+	return nil
+}
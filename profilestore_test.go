@@ -0,0 +1,108 @@
+// Copyright 2016 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+package alpenhorn
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestJSONFileStoreChangePassphraseSticks(t *testing.T) {
+	dir := t.TempDir()
+	store := NewJSONFileStore(
+		filepath.Join(dir, "client"),
+		filepath.Join(dir, "keywheel"),
+		"old-passphrase",
+	)
+
+	st := &persistedState{Username: "alice", Friends: make(map[string]*persistedFriend)}
+	if err := store.SaveClient(st); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.SaveKeywheel([]byte("keywheel bytes")); err != nil {
+		t.Fatal(err)
+	}
+
+	pc, ok := store.(passphraseChanger)
+	if !ok {
+		t.Fatal("jsonFileStore does not implement passphraseChanger")
+	}
+	if err := pc.changePassphrase("old-passphrase", "new-passphrase"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The change must be visible on the *same* store instance (this is
+	// what persistClientLocked/persistKeywheelLocked use from then on),
+	// not just written to disk and then reverted by the next save.
+	if _, _, err := store.Load(); err != nil {
+		t.Fatalf("loading with the store after changePassphrase: %s", err)
+	}
+
+	if err := store.SaveClient(st); err != nil {
+		t.Fatal(err)
+	}
+
+	reloaded := NewJSONFileStore(
+		filepath.Join(dir, "client"),
+		filepath.Join(dir, "keywheel"),
+		"new-passphrase",
+	)
+	if _, _, err := reloaded.Load(); err != nil {
+		t.Fatalf("file was not saved under the new passphrase: %s", err)
+	}
+
+	stale := NewJSONFileStore(
+		filepath.Join(dir, "client"),
+		filepath.Join(dir, "keywheel"),
+		"old-passphrase",
+	)
+	if _, _, err := stale.Load(); err == nil {
+		t.Fatal("file still opens with the old passphrase after ChangePassphrase")
+	}
+}
+
+func TestMigrateToJSONFileStorePreservesFriends(t *testing.T) {
+	dir := t.TempDir()
+	old := NewJSONFileStore(
+		filepath.Join(dir, "old-client"),
+		filepath.Join(dir, "old-keywheel"),
+		"",
+	)
+	st := &persistedState{
+		Username: "alice",
+		Friends: map[string]*persistedFriend{
+			"bob": {Username: "bob"},
+		},
+	}
+	if err := old.SaveClient(st); err != nil {
+		t.Fatal(err)
+	}
+	if err := old.SaveKeywheel([]byte("keywheel bytes")); err != nil {
+		t.Fatal(err)
+	}
+
+	newStore := NewJSONFileStore(
+		filepath.Join(dir, "new-client"),
+		filepath.Join(dir, "new-keywheel"),
+		"",
+	)
+	err := Migrate(
+		filepath.Join(dir, "old-client"),
+		filepath.Join(dir, "old-keywheel"),
+		"",
+		newStore,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, _, err := newStore.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.Friends["bob"] == nil {
+		t.Fatal("Migrate into a jsonFileStore silently dropped bob")
+	}
+}
@@ -0,0 +1,171 @@
+// Copyright 2016 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+package alpenhorn
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/nacl/secretbox"
+)
+
+// Persisted client and keywheel files can optionally be sealed with a
+// passphrase. The on-disk format is:
+//
+//	magic (4 bytes) || version (1 byte) ||
+//	argon2 time (4 bytes) || argon2 memory (4 bytes) || argon2 threads (1 byte) ||
+//	salt (16 bytes) || nonce (24 bytes) || secretbox(ciphertext || tag)
+//
+// Files that do not begin with sealMagic are assumed to be plain JSON (or
+// keywheel) data from before encryption support was added, so the
+// unencrypted format keeps working without a passphrase.
+const (
+	sealMagic   = "ApHn"
+	sealVersion = 1
+
+	sealSaltSize  = 16
+	sealNonceSize = 24
+	sealKeySize   = 32
+
+	sealHeaderSize = len(sealMagic) + 1 + 4 + 4 + 1 + sealSaltSize + sealNonceSize
+)
+
+// argon2Params are the default argon2id parameters used to derive a
+// sealing key from a passphrase. They are stored alongside the salt in
+// the header so that a file sealed with older, lighter parameters can
+// still be opened.
+var argon2Params = struct {
+	time, memory uint32
+	threads      uint8
+}{
+	time:    1,
+	memory:  64 * 1024, // 64 MiB
+	threads: 4,
+}
+
+// isSealed reports whether data looks like it was produced by seal.
+func isSealed(data []byte) bool {
+	return bytes.HasPrefix(data, []byte(sealMagic))
+}
+
+// seal encrypts data under a key derived from passphrase using
+// argon2id and nacl/secretbox, and prepends a versioned header
+// recording the KDF parameters, salt, and nonce.
+func seal(data []byte, passphrase string) ([]byte, error) {
+	var salt [sealSaltSize]byte
+	if _, err := io.ReadFull(rand.Reader, salt[:]); err != nil {
+		return nil, err
+	}
+	var nonce [sealNonceSize]byte
+	if _, err := io.ReadFull(rand.Reader, nonce[:]); err != nil {
+		return nil, err
+	}
+
+	key := deriveSealKey(passphrase, salt[:], argon2Params.time, argon2Params.memory, argon2Params.threads)
+
+	header := new(bytes.Buffer)
+	header.WriteString(sealMagic)
+	header.WriteByte(sealVersion)
+	binary.Write(header, binary.BigEndian, argon2Params.time)
+	binary.Write(header, binary.BigEndian, argon2Params.memory)
+	header.WriteByte(argon2Params.threads)
+	header.Write(salt[:])
+	header.Write(nonce[:])
+
+	return secretbox.Seal(header.Bytes(), data, &nonce, &key), nil
+}
+
+// unseal reverses seal, deriving the key from the header's stored
+// KDF parameters and salt.
+func unseal(sealed []byte, passphrase string) ([]byte, error) {
+	if len(sealed) < sealHeaderSize {
+		return nil, errors.New("alpenhorn: sealed data is truncated")
+	}
+
+	r := bytes.NewReader(sealed[len(sealMagic):])
+
+	var version uint8
+	if err := binary.Read(r, binary.BigEndian, &version); err != nil {
+		return nil, err
+	}
+	if version != sealVersion {
+		return nil, fmt.Errorf("alpenhorn: unsupported seal version %d", version)
+	}
+
+	var time, memory uint32
+	var threads uint8
+	if err := binary.Read(r, binary.BigEndian, &time); err != nil {
+		return nil, err
+	}
+	if err := binary.Read(r, binary.BigEndian, &memory); err != nil {
+		return nil, err
+	}
+	if err := binary.Read(r, binary.BigEndian, &threads); err != nil {
+		return nil, err
+	}
+
+	var salt [sealSaltSize]byte
+	if _, err := io.ReadFull(r, salt[:]); err != nil {
+		return nil, err
+	}
+	var nonce [sealNonceSize]byte
+	if _, err := io.ReadFull(r, nonce[:]); err != nil {
+		return nil, err
+	}
+
+	ciphertext := sealed[sealHeaderSize:]
+	key := deriveSealKey(passphrase, salt[:], time, memory, threads)
+
+	opened, ok := secretbox.Open(nil, ciphertext, &nonce, &key)
+	if !ok {
+		return nil, errors.New("alpenhorn: failed to decrypt persisted state (wrong passphrase?)")
+	}
+	return opened, nil
+}
+
+// maybeUnseal unseals data if it is sealed, otherwise it returns data
+// unchanged to support the pre-encryption, plaintext file format.
+func maybeUnseal(data []byte, passphrase string) ([]byte, error) {
+	if !isSealed(data) {
+		return data, nil
+	}
+	if passphrase == "" {
+		return nil, errors.New("alpenhorn: persisted state is encrypted but no passphrase was given")
+	}
+	return unseal(data, passphrase)
+}
+
+func deriveSealKey(passphrase string, salt []byte, time, memory uint32, threads uint8) [sealKeySize]byte {
+	var key [sealKeySize]byte
+	copy(key[:], argon2.IDKey([]byte(passphrase), salt, time, memory, threads, sealKeySize))
+	return key
+}
+
+// zero overwrites b with zeros. It's used to scrub private key material
+// from memory once it has been serialized to disk.
+func zero(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
+
+// clonePrivateKey returns a copy of k backed by its own array. Callers
+// that zero the result (e.g. persistClientLocked, via zero above) must
+// use clonePrivateKey rather than assigning k directly, or they'll wipe
+// the only copy of the key still in use by the live Client.
+func clonePrivateKey(k ed25519.PrivateKey) ed25519.PrivateKey {
+	if k == nil {
+		return nil
+	}
+	clone := make(ed25519.PrivateKey, len(k))
+	copy(clone, k)
+	return clone
+}
@@ -0,0 +1,71 @@
+// Copyright 2016 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+package alpenhorn
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"testing"
+
+	"vuvuzela.io/crypto/rand"
+)
+
+func TestSealUnseal(t *testing.T) {
+	data := []byte("sekrit profile data")
+	sealed, err := seal(data, "hunter2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !isSealed(sealed) {
+		t.Fatal("sealed data does not start with sealMagic")
+	}
+
+	opened, err := unseal(sealed, "hunter2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(opened, data) {
+		t.Fatalf("unseal returned %q, want %q", opened, data)
+	}
+
+	if _, err := unseal(sealed, "wrong passphrase"); err == nil {
+		t.Fatal("unseal succeeded with the wrong passphrase")
+	}
+}
+
+func TestMaybeUnsealPlaintext(t *testing.T) {
+	// Files written before encryption support existed have no magic
+	// prefix and should pass through unchanged, with no passphrase
+	// required.
+	data := []byte(`{"Username":"alice"}`)
+	out, err := maybeUnseal(data, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out, data) {
+		t.Fatalf("maybeUnseal modified unsealed data: got %q, want %q", out, data)
+	}
+}
+
+func TestClonePrivateKeyIndependentBacking(t *testing.T) {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clone := clonePrivateKey(priv)
+	zero(clone)
+
+	allZero := true
+	for _, b := range priv {
+		if b != 0 {
+			allZero = false
+			break
+		}
+	}
+	if allZero {
+		t.Fatal("zeroing the clone also zeroed the original key; clonePrivateKey is aliasing")
+	}
+}